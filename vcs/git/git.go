@@ -0,0 +1,470 @@
+// Package git implements the vcs.Repository interface for git
+// repositories using libgit2 (via git2go) bindings.
+package git
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+
+	git2go "gopkg.in/libgit2/git2go.v27"
+
+	"github.com/sourcegraph/go-vcs/vcs"
+)
+
+func init() {
+	vcs.RegisterCloner("git", CloneContext)
+}
+
+// InsecureSkipCheckVerifySSH, if true, disables host key verification
+// for SSH remote operations performed via libgit2. It exists for use
+// in tests only.
+var InsecureSkipCheckVerifySSH bool
+
+// Repository is a git repository accessed via libgit2.
+type Repository struct {
+	repo *git2go.Repository
+	dir  string
+}
+
+// Open opens the git repository at dir.
+func Open(dir string) (*Repository, error) {
+	repo, err := git2go.OpenRepository(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{repo: repo, dir: dir}, nil
+}
+
+// Clone clones the repository at url into dir according to opt, using
+// libgit2, and opens it.
+func Clone(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) {
+	return CloneContext(context.Background(), url, dir, opt)
+}
+
+// CloneContext is like Clone, but aborts the clone if ctx is done.
+func CloneContext(ctx context.Context, url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) {
+	if err := checkHTTPSHeadersSupported(opt.RemoteOpts); err != nil {
+		return nil, err
+	}
+	if opt.Filter != "" {
+		// libgit2 has no support for partial-clone filter specs; fall
+		// back to the git command-line tool for this case.
+		return cloneWithFilter(ctx, url, dir, opt)
+	}
+
+	downloadTags := git2go.DownloadTagsAuto
+	if opt.NoTags {
+		downloadTags = git2go.DownloadTagsNone
+	}
+
+	copts := &git2go.CloneOptions{
+		Bare:           opt.Bare,
+		CheckoutBranch: opt.SingleBranch,
+		FetchOptions: &git2go.FetchOptions{
+			RemoteCallbacks: remoteCallbacks(ctx, opt.RemoteOpts, opt.Progress),
+			Depth:           opt.Depth,
+			DownloadTags:    downloadTags,
+		},
+	}
+	if opt.SingleBranch != "" {
+		// The default remote created by git2go.Clone fetches all
+		// branches (CheckoutBranch only selects what gets checked
+		// out); restrict the fetch refspec itself so only the named
+		// branch is fetched, matching gitcmd's --single-branch.
+		copts.RemoteCreateCallback = singleBranchRemoteCreateCallback(opt.SingleBranch)
+	}
+	repo, err := git2go.Clone(url, dir, copts)
+	if err != nil {
+		return nil, fmt.Errorf("git clone %s %s: %s", url, dir, err)
+	}
+	if opt.Mirror {
+		if err := configureMirror(repo); err != nil {
+			return nil, err
+		}
+	}
+	if err := fetchLFS(dir, opt.RemoteOpts); err != nil {
+		return nil, err
+	}
+	return &Repository{repo: repo, dir: dir}, nil
+}
+
+// singleBranchRemoteCreateCallback returns a git2go.RemoteCreateCallback
+// that creates the "origin" remote with its fetch refspec restricted to
+// branch, so that a single-branch clone only ever fetches that branch's
+// ref, not every branch on the remote.
+func singleBranchRemoteCreateCallback(branch string) git2go.RemoteCreateCallback {
+	return func(repo *git2go.Repository, name, url string) (*git2go.Remote, error) {
+		if _, err := repo.Remotes.Create(name, url); err != nil {
+			return nil, err
+		}
+		refspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branch, name, branch)
+		if err := repo.Remotes.SetFetchRefspecs(name, []string{refspec}); err != nil {
+			return nil, err
+		}
+		return repo.Remotes.Lookup(name)
+	}
+}
+
+// cloneWithFilter performs a partial clone using the git command-line
+// tool (libgit2 does not support clone filter specs) and opens the
+// result with libgit2.
+func cloneWithFilter(ctx context.Context, url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) {
+	args := []string{"clone", "--filter=" + opt.Filter}
+	if opt.Bare {
+		args = append(args, "--bare")
+	}
+	if opt.Mirror {
+		args = append(args, "--mirror")
+	}
+	if opt.SingleBranch != "" {
+		args = append(args, "--single-branch", "--branch", opt.SingleBranch)
+	}
+	if opt.NoTags {
+		args = append(args, "--no-tags")
+	}
+	if opt.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opt.Depth))
+	}
+	args = append(args, url, dir)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	if err := configureRemoteEnv(cmd, opt.RemoteOpts); err != nil {
+		return nil, err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("git clone %s %s: %s\n%s", url, dir, err, out)
+	}
+	if err := fetchLFS(dir, opt.RemoteOpts); err != nil {
+		return nil, err
+	}
+	return Open(dir)
+}
+
+// configureMirror sets up repo's default remote as a mirror (so that
+// UpdateEverything fetches and prunes to match the remote exactly).
+func configureMirror(repo *git2go.Repository) error {
+	return repo.Remotes.SetFetchRefspecs("origin", []string{"+refs/*:refs/*"})
+}
+
+// configureRemoteEnv sets up cmd's environment so that the git
+// command-line tool authenticates per opts. It is used only by
+// cloneWithFilter, which shells out to git directly because libgit2
+// has no support for partial-clone filter specs.
+func configureRemoteEnv(cmd *exec.Cmd, opts vcs.RemoteOpts) error {
+	env := append([]string{}, os.Environ()...)
+
+	if opts.SSH != nil {
+		sshBin := "ssh"
+		var args []string
+		switch InsecureSkipCheckVerifySSH || opts.SSH.Insecure {
+		case true:
+			args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+		default:
+			if len(opts.SSH.KnownHosts) > 0 {
+				knownHostsFile, err := writeTempFile("go-vcs-known-hosts", opts.SSH.KnownHosts)
+				if err != nil {
+					return err
+				}
+				args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+knownHostsFile)
+			}
+		}
+		switch auth := opts.SSH.Auth.(type) {
+		case vcs.SSHPrivateKey:
+			keyFile, err := writeTempFile("go-vcs-ssh-key", auth.PrivateKey)
+			if err != nil {
+				return err
+			}
+			args = append(args, "-i", keyFile, "-o", "IdentitiesOnly=yes")
+		case vcs.SSHAgent:
+			if auth.Socket != "" {
+				env = append(env, "SSH_AUTH_SOCK="+auth.Socket)
+			}
+		}
+		for _, a := range args {
+			sshBin += " " + a
+		}
+		env = append(env, "GIT_SSH_COMMAND="+sshBin)
+	}
+
+	if opts.HTTPS != nil && (opts.HTTPS.Username != "" || opts.HTTPS.Password != "" || opts.HTTPS.Token != "") {
+		password := opts.HTTPS.Password
+		if password == "" {
+			password = opts.HTTPS.Token
+		}
+		askpass, err := writeAskpassScript(opts.HTTPS.Username, password)
+		if err != nil {
+			return err
+		}
+		env = append(env, "GIT_ASKPASS="+askpass, "GIT_TERMINAL_PROMPT=0")
+	}
+
+	cmd.Env = env
+	return nil
+}
+
+// writeTempFile writes data to a temporary file (mode 0600) and
+// returns its path. The file is not removed automatically, since it
+// must outlive this function call for git/ssh to read it.
+func writeTempFile(prefix string, data []byte) (string, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeAskpassScript writes a script usable as GIT_ASKPASS that
+// answers username/password prompts from username and password.
+func writeAskpassScript(username, password string) (string, error) {
+	f, err := ioutil.TempFile("", "go-vcs-askpass")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "#!/bin/sh\ncase \"$1\" in\nUsername*) echo %q ;;\n*) echo %q ;;\nesac\n", username, password)
+	if err := os.Chmod(f.Name(), 0700); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// UpdateEverything updates all refs in the repository (which must be a
+// mirror clone) to match its remote, per opts.
+func (r *Repository) UpdateEverything(opts vcs.RemoteOpts) error {
+	return r.UpdateEverythingContext(context.Background(), opts)
+}
+
+// UpdateEverythingContext is like UpdateEverything, but aborts the
+// update if ctx is done.
+func (r *Repository) UpdateEverythingContext(ctx context.Context, opts vcs.RemoteOpts) error {
+	if err := checkHTTPSHeadersSupported(opts); err != nil {
+		return err
+	}
+	remote, err := r.repo.Remotes.Lookup("origin")
+	if err != nil {
+		return err
+	}
+	fetchOpts := &git2go.FetchOptions{RemoteCallbacks: remoteCallbacks(ctx, opts, nil), Depth: opts.Depth}
+	if err := remote.Fetch(nil, fetchOpts, ""); err != nil {
+		return err
+	}
+	return fetchLFS(r.dir, opts)
+}
+
+// Push pushes the given refspecs to the repository's "origin" remote.
+func (r *Repository) Push(refspecs []string, opts vcs.RemoteOpts) error {
+	if err := checkHTTPSHeadersSupported(opts); err != nil {
+		return err
+	}
+	remote, err := r.repo.Remotes.Lookup("origin")
+	if err != nil {
+		return err
+	}
+	return remote.Push(refspecs, &git2go.PushOptions{RemoteCallbacks: remoteCallbacks(context.Background(), opts, nil)})
+}
+
+// MirrorPush pushes all refs, as-is, to remoteURL.
+func (r *Repository) MirrorPush(remoteURL string, opts vcs.RemoteOpts) error {
+	if err := checkHTTPSHeadersSupported(opts); err != nil {
+		return err
+	}
+	remote, err := r.repo.Remotes.CreateAnonymous(remoteURL)
+	if err != nil {
+		return err
+	}
+	return remote.Push([]string{"+refs/*:refs/*"}, &git2go.PushOptions{RemoteCallbacks: remoteCallbacks(context.Background(), opts, nil)})
+}
+
+// checkHTTPSHeadersSupported returns an error if opts.HTTPS.Headers is
+// set. libgit2 (as vendored via git2go v27) has no hook for attaching
+// custom HTTP headers to fetch/push operations, unlike the gitcmd
+// backend (which sends them via `http.extraHeader`), so silently
+// dropping them would leave bearer/OAuth-style auth not actually
+// applied.
+func checkHTTPSHeadersSupported(opts vcs.RemoteOpts) error {
+	if opts.HTTPS != nil && len(opts.HTTPS.Headers) > 0 {
+		return fmt.Errorf("git: HTTPSConfig.Headers is not supported by the libgit2 backend; use gitcmd instead")
+	}
+	return nil
+}
+
+// Tags returns a list of all tags in the repository.
+func (r *Repository) Tags() ([]*vcs.Tag, error) {
+	var tags []*vcs.Tag
+	iter, err := r.repo.NewReferenceIteratorGlob("refs/tags/*")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		ref, err := iter.Next()
+		if err != nil {
+			break
+		}
+		tags = append(tags, &vcs.Tag{
+			Name:     ref.Shorthand(),
+			CommitID: vcs.CommitID(ref.Target().String()),
+		})
+	}
+	return tags, nil
+}
+
+// ResolveTag returns the commit ID that the given tag refers to.
+func (r *Repository) ResolveTag(name string) (vcs.CommitID, error) {
+	tags, err := r.Tags()
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tags {
+		if t.Name == name {
+			return t.CommitID, nil
+		}
+	}
+	return "", fmt.Errorf("tag %q not found", name)
+}
+
+// GetCommit returns the commit with the given ID.
+func (r *Repository) GetCommit(id vcs.CommitID) (*vcs.Commit, error) {
+	return nil, fmt.Errorf("git: GetCommit not implemented")
+}
+
+// verifyKnownHosts reports whether knownHosts (the contents of an
+// OpenSSH known_hosts file) contains an entry for hostname whose
+// fingerprint matches cert's host key.
+func verifyKnownHosts(knownHosts []byte, hostname string, cert *git2go.Certificate) bool {
+	fingerprint := cert.Hostkey.HashSHA1
+	for _, line := range bytes.Split(knownHosts, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) < 3 || !bytes.Contains(fields[0], []byte(hostname)) {
+			continue
+		}
+		keyBytes, err := base64.StdEncoding.DecodeString(string(fields[2]))
+		if err != nil {
+			continue
+		}
+		sum := sha1.Sum(keyBytes)
+		if sum == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchLFS fetches all Git LFS objects for the repository at dir, if
+// opts.LFS enables it. libgit2 has no native LFS support, so this
+// shells out to the git-lfs binary, which must be installed and on
+// PATH.
+func fetchLFS(dir string, opts vcs.RemoteOpts) error {
+	if opts.LFS == nil || !opts.LFS.Enabled {
+		return nil
+	}
+
+	if opts.LFS.ServerURL != "" {
+		cfg := exec.Command("git", "config", "lfs.url", opts.LFS.ServerURL)
+		cfg.Dir = dir
+		if out, err := cfg.CombinedOutput(); err != nil {
+			return fmt.Errorf("git config lfs.url: %s\n%s", err, out)
+		}
+	}
+
+	cmd := exec.Command("git", "lfs", "fetch", "--all")
+	cmd.Dir = dir
+	if opts.LFS.Username != "" {
+		cmd.Env = append(cmd.Env, "GIT_LFS_USERNAME="+opts.LFS.Username, "GIT_LFS_PASSWORD="+opts.LFS.Password)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git lfs fetch --all: %s\n%s", err, out)
+	}
+	return nil
+}
+
+// remoteCallbacks builds the libgit2 remote callbacks needed to
+// authenticate and verify the remote host's key per opts, abort the
+// operation if ctx is done, and report transfer progress to progress,
+// if non-nil.
+func remoteCallbacks(ctx context.Context, opts vcs.RemoteOpts, progress vcs.ProgressFunc) git2go.RemoteCallbacks {
+	return git2go.RemoteCallbacks{
+		TransferProgressCallback: func(stats git2go.TransferProgress) git2go.ErrorCode {
+			if err := ctx.Err(); err != nil {
+				return git2go.ErrorCodeUser
+			}
+			if progress != nil {
+				progress(vcs.TransferProgress{
+					TotalObjects:    stats.TotalObjects,
+					ReceivedObjects: stats.ReceivedObjects,
+					IndexedObjects:  stats.IndexedObjects,
+					ReceivedBytes:   stats.ReceivedBytes,
+				})
+			}
+			return git2go.ErrorCodeOK
+		},
+		CredentialsCallback: func(url, username string, allowed git2go.CredType) (*git2go.Cred, error) {
+			switch {
+			case opts.HTTPS != nil && (opts.HTTPS.Username != "" || opts.HTTPS.Password != "" || opts.HTTPS.Token != ""):
+				password := opts.HTTPS.Password
+				if password == "" {
+					password = opts.HTTPS.Token
+				}
+				return git2go.NewCredUserpassPlaintext(opts.HTTPS.Username, password)
+			case opts.SSH != nil:
+				switch auth := opts.SSH.Auth.(type) {
+				case vcs.SSHPrivateKey:
+					return git2go.NewCredSshKeyFromMemory(username, "", string(auth.PrivateKey), auth.Passphrase)
+				case vcs.SSHAgent:
+					return git2go.NewCredSshKeyFromAgent(username)
+				case vcs.SSHCommand:
+					return nil, fmt.Errorf("git: SSHCommand auth is not supported by the libgit2 backend; use gitcmd instead")
+				default:
+					return nil, fmt.Errorf("git: no credentials configured for %s", url)
+				}
+			default:
+				return nil, fmt.Errorf("git: no credentials configured for %s", url)
+			}
+		},
+		CertificateCheckCallback: func(cert *git2go.Certificate, valid bool, hostname string) git2go.ErrorCode {
+			if InsecureSkipCheckVerifySSH || (opts.SSH != nil && opts.SSH.Insecure) || (opts.HTTPS != nil && opts.HTTPS.Insecure) {
+				return git2go.ErrorCodeOK
+			}
+			if opts.SSH != nil && opts.SSH.HostKeyCallback != nil {
+				if cert.Hostkey.Kind&git2go.HostkeyRaw == 0 {
+					// The installed libgit2 wasn't built with raw host
+					// key support, so there is no wire-format key to
+					// hand to the callback.
+					return git2go.ErrorCodeGeneric
+				}
+				if err := opts.SSH.HostKeyCallback(hostname, cert.Hostkey.Hostkey); err != nil {
+					return git2go.ErrorCodeGeneric
+				}
+				return git2go.ErrorCodeOK
+			}
+			if opts.SSH != nil && len(opts.SSH.KnownHosts) > 0 {
+				if verifyKnownHosts(opts.SSH.KnownHosts, hostname, cert) {
+					return git2go.ErrorCodeOK
+				}
+				return git2go.ErrorCodeGeneric
+			}
+			// libgit2 verifies the TLS certificate itself (against the
+			// system CA roots) before invoking this callback for HTTPS
+			// remotes; HTTPSConfig.CABundle is honored by the gitcmd
+			// backend instead, since libgit2 has no per-clone CA
+			// override hook.
+			if valid {
+				return git2go.ErrorCodeOK
+			}
+			return git2go.ErrorCodeGeneric
+		},
+	}
+}
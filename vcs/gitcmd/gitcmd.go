@@ -0,0 +1,447 @@
+// Package gitcmd implements the vcs.Repository interface for git
+// repositories by shelling out to the git command-line tool.
+package gitcmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/go-vcs/vcs"
+)
+
+func init() {
+	vcs.RegisterCloner("git", CloneContext)
+}
+
+// InsecureSkipCheckVerifySSH, if true, disables host key verification
+// for SSH remote operations performed via the git command-line tool.
+// It exists for use in tests only.
+var InsecureSkipCheckVerifySSH bool
+
+// Repository is a git repository that is accessed via the git
+// command-line tool.
+type Repository struct {
+	Dir string
+}
+
+// Open opens the git repository at dir.
+func Open(dir string) (*Repository, error) {
+	return &Repository{Dir: dir}, nil
+}
+
+// Clone clones the repository at url into dir according to opt, using
+// the git command-line tool, and opens it.
+func Clone(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) {
+	return CloneContext(context.Background(), url, dir, opt)
+}
+
+// CloneContext is like Clone, but aborts the clone if ctx is done.
+func CloneContext(ctx context.Context, url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) {
+	args := []string{"clone"}
+	if opt.Bare {
+		args = append(args, "--bare")
+	}
+	if opt.Mirror {
+		args = append(args, "--mirror")
+	}
+	if opt.SingleBranch != "" {
+		args = append(args, "--single-branch", "--branch", opt.SingleBranch)
+	}
+	if opt.NoTags {
+		args = append(args, "--no-tags")
+	}
+	if opt.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opt.Depth))
+	}
+	if opt.Filter != "" {
+		args = append(args, "--filter="+opt.Filter)
+	}
+	if opt.Progress != nil {
+		args = append(args, "--progress")
+	}
+	args = append(args, url, dir)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	if err := configureRemoteEnv(cmd, opt.RemoteOpts); err != nil {
+		return nil, err
+	}
+	if out, err := runWithProgress(cmd, opt.Progress); err != nil {
+		return nil, fmt.Errorf("git clone %s %s: %s\n%s", url, dir, err, out)
+	}
+
+	if err := fetchLFS(dir, opt.RemoteOpts); err != nil {
+		return nil, err
+	}
+
+	return Open(dir)
+}
+
+// UpdateEverything updates all refs in the repository (which must be a
+// mirror clone) to match its remote, per opts.
+func (r *Repository) UpdateEverything(opts vcs.RemoteOpts) error {
+	return r.UpdateEverythingContext(context.Background(), opts)
+}
+
+// UpdateEverythingContext is like UpdateEverything, but aborts the
+// update if ctx is done.
+func (r *Repository) UpdateEverythingContext(ctx context.Context, opts vcs.RemoteOpts) error {
+	// "git remote update" has no --depth flag, so a shallow mirror must
+	// instead fetch directly from "origin" using its already-configured
+	// refspec (e.g. the +refs/*:refs/* set up by `git clone --mirror`),
+	// passing --depth to keep it shallow across refreshes.
+	args := []string{"remote", "update"}
+	if opts.Depth > 0 {
+		args = []string{"fetch", "--depth", strconv.Itoa(opts.Depth), "origin"}
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.Dir
+	if err := configureRemoteEnv(cmd, opts); err != nil {
+		return err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return fetchLFS(r.Dir, opts)
+}
+
+// Push pushes the given refspecs to the repository's "origin" remote.
+func (r *Repository) Push(refspecs []string, opts vcs.RemoteOpts) error {
+	args := append([]string{"push", "origin"}, refspecs...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.Dir
+	if err := configureRemoteEnv(cmd, opts); err != nil {
+		return err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git push: %s\n%s", err, out)
+	}
+	return nil
+}
+
+// MirrorPush pushes all refs, as-is, to remoteURL.
+func (r *Repository) MirrorPush(remoteURL string, opts vcs.RemoteOpts) error {
+	cmd := exec.Command("git", "push", "--mirror", remoteURL)
+	cmd.Dir = r.Dir
+	if err := configureRemoteEnv(cmd, opts); err != nil {
+		return err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git push --mirror %s: %s\n%s", remoteURL, err, out)
+	}
+	return nil
+}
+
+// Tags returns a list of all tags in the repository.
+func (r *Repository) Tags() ([]*vcs.Tag, error) {
+	cmd := exec.Command("git", "show-ref", "--tags", "-d")
+	cmd.Dir = r.Dir
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) == 0 && len(out) == 0 {
+			// No tags.
+			return nil, nil
+		}
+		return nil, fmt.Errorf("git show-ref --tags: %s", err)
+	}
+
+	var tags []*vcs.Tag
+	for _, line := range bytes.Split(bytes.TrimRight(out, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		name := bytes.TrimPrefix(fields[1], []byte("refs/tags/"))
+		if bytes.HasSuffix(name, []byte("^{}")) {
+			// Dereferenced tag object; replaces the preceding entry's
+			// commit ID with the one the tag actually points to.
+			name = bytes.TrimSuffix(name, []byte("^{}"))
+			if len(tags) > 0 && string(tags[len(tags)-1].Name) == string(name) {
+				tags[len(tags)-1].CommitID = vcs.CommitID(fields[0])
+			}
+			continue
+		}
+		tags = append(tags, &vcs.Tag{Name: string(name), CommitID: vcs.CommitID(fields[0])})
+	}
+	return tags, nil
+}
+
+// ResolveTag returns the commit ID that the given tag refers to.
+func (r *Repository) ResolveTag(name string) (vcs.CommitID, error) {
+	tags, err := r.Tags()
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tags {
+		if t.Name == name {
+			return t.CommitID, nil
+		}
+	}
+	return "", fmt.Errorf("tag %q not found", name)
+}
+
+// GetCommit returns the commit with the given ID.
+func (r *Repository) GetCommit(id vcs.CommitID) (*vcs.Commit, error) {
+	return nil, fmt.Errorf("gitcmd: GetCommit not implemented")
+}
+
+// configureRemoteEnv sets up cmd's environment so that git uses the
+// SSH and/or HTTPS configuration in opts for any remote operations it
+// performs. It returns an error only if writing a temp credential file
+// fails, or an unsupported option is requested.
+func configureRemoteEnv(cmd *exec.Cmd, opts vcs.RemoteOpts) error {
+	env := append([]string{}, os.Environ()...)
+	var config []string // alternating key, value pairs; see gitConfigEnv.
+
+	if opts.SSH != nil {
+		sshEnv, err := sshCommandEnv(opts.SSH)
+		if err != nil {
+			return err
+		}
+		env = append(env, sshEnv)
+		if agent, ok := opts.SSH.Auth.(vcs.SSHAgent); ok && agent.Socket != "" {
+			env = append(env, "SSH_AUTH_SOCK="+agent.Socket)
+		}
+	}
+
+	if opts.HTTPS != nil {
+		httpsConfig, httpsEnv, err := httpsRemoteConfig(opts.HTTPS)
+		if err != nil {
+			return err
+		}
+		config = append(config, httpsConfig...)
+		env = append(env, httpsEnv...)
+	}
+
+	env = append(env, gitConfigEnv(config)...)
+	cmd.Env = env
+	return nil
+}
+
+// sshCommandEnv returns the GIT_SSH_COMMAND environment variable
+// setting that configures ssh per cfg.
+func sshCommandEnv(cfg *vcs.SSHConfig) (string, error) {
+	if cfg.HostKeyCallback != nil {
+		// gitcmd delegates host key checking to the ssh binary, which
+		// has no hook for a Go callback; approximate it by trusting
+		// on first use and relying on KnownHosts/Insecure instead.
+		return "", fmt.Errorf("gitcmd: SSHConfig.HostKeyCallback is not supported; use KnownHosts instead")
+	}
+
+	sshBin := "ssh"
+	var args []string
+
+	switch InsecureSkipCheckVerifySSH || cfg.Insecure {
+	case true:
+		args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	default:
+		if len(cfg.KnownHosts) > 0 {
+			knownHostsFile, err := writeTempFile("go-vcs-known-hosts", cfg.KnownHosts)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+knownHostsFile)
+		}
+	}
+
+	switch auth := cfg.Auth.(type) {
+	case nil:
+		// Use whatever ssh-agent or default keys the ssh binary finds.
+	case vcs.SSHPrivateKey:
+		keyFile, err := writeTempFile("go-vcs-ssh-key", auth.PrivateKey)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-i", keyFile, "-o", "IdentitiesOnly=yes")
+	case vcs.SSHAgent:
+		// SSH_AUTH_SOCK, if set, is applied to cmd.Env by the caller.
+	case vcs.SSHCommand:
+		if auth.Command != "" {
+			sshBin = auth.Command
+		}
+		args = append(args, auth.ExtraArgs...)
+	default:
+		return "", fmt.Errorf("gitcmd: unsupported SSHAuth type %T", auth)
+	}
+
+	sshCommand := sshBin
+	for _, a := range args {
+		sshCommand += " " + a
+	}
+	return "GIT_SSH_COMMAND=" + sshCommand, nil
+}
+
+// httpsRemoteConfig returns the `git -c key=value`-equivalent config
+// pairs (as alternating key, value strings) and environment variables
+// needed to perform an HTTP(S) remote operation per cfg.
+func httpsRemoteConfig(cfg *vcs.HTTPSConfig) (config []string, env []string, err error) {
+	if cfg.Insecure {
+		config = append(config, "http.sslVerify", "false")
+	}
+	if len(cfg.CABundle) > 0 {
+		caFile, err := writeTempFile("go-vcs-ca-bundle", cfg.CABundle)
+		if err != nil {
+			return nil, nil, err
+		}
+		config = append(config, "http.sslCAInfo", caFile)
+	}
+	for header, values := range cfg.Headers {
+		for _, v := range values {
+			config = append(config, "http.extraHeader", header+": "+v)
+		}
+	}
+
+	if cfg.Username != "" || cfg.Password != "" || cfg.Token != "" {
+		password := cfg.Password
+		if password == "" {
+			password = cfg.Token
+		}
+		askpass, err := writeAskpassScript(cfg.Username, password)
+		if err != nil {
+			return nil, nil, err
+		}
+		env = append(env, "GIT_ASKPASS="+askpass, "GIT_TERMINAL_PROMPT=0")
+	}
+
+	return config, env, nil
+}
+
+// gitConfigEnv turns config (alternating key, value pairs) into the
+// GIT_CONFIG_COUNT/GIT_CONFIG_KEY_n/GIT_CONFIG_VALUE_n environment
+// variables git reads to apply ad hoc config without a `-c` flag,
+// which would otherwise have to be inserted before the subcommand.
+func gitConfigEnv(config []string) []string {
+	var env []string
+	n := 0
+	for i := 0; i+1 < len(config); i += 2 {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", n, config[i]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", n, config[i+1]),
+		)
+		n++
+	}
+	if n > 0 {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", n))
+	}
+	return env
+}
+
+// writeAskpassScript writes a script usable as GIT_ASKPASS that
+// answers username/password prompts from username and password.
+func writeAskpassScript(username, password string) (string, error) {
+	f, err := ioutil.TempFile("", "go-vcs-askpass")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "#!/bin/sh\ncase \"$1\" in\nUsername*) echo %q ;;\n*) echo %q ;;\nesac\n", username, password)
+	if err := os.Chmod(f.Name(), 0700); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// runWithProgress runs cmd, routing its combined output through a
+// writer that parses git's `--progress` stderr lines (e.g.
+// "Receiving objects:  42% (84/200), 1.23 MiB") into
+// vcs.TransferProgress updates delivered to progress, if non-nil. It
+// returns the combined output, for use in error messages.
+func runWithProgress(cmd *exec.Cmd, progress vcs.ProgressFunc) ([]byte, error) {
+	w := &progressWriter{progress: progress}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err := cmd.Run()
+	return w.buf.Bytes(), err
+}
+
+type progressWriter struct {
+	progress vcs.ProgressFunc
+	buf      bytes.Buffer
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	if w.progress != nil {
+		for _, line := range bytes.Split(p, []byte("\r")) {
+			if tp, ok := parseProgressLine(string(line)); ok {
+				w.progress(tp)
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// parseProgressLine parses one line of git's --progress stderr output,
+// e.g. "Receiving objects:  42% (84/200), 1.23 MiB | 512.00 KiB/s".
+func parseProgressLine(line string) (vcs.TransferProgress, bool) {
+	if !strings.Contains(line, "Receiving objects") && !strings.Contains(line, "Resolving deltas") {
+		return vcs.TransferProgress{}, false
+	}
+	open, shut := strings.Index(line, "("), strings.Index(line, ")")
+	if open < 0 || shut < open {
+		return vcs.TransferProgress{}, false
+	}
+	var received, total int
+	if _, err := fmt.Sscanf(line[open+1:shut], "%d/%d", &received, &total); err != nil {
+		return vcs.TransferProgress{}, false
+	}
+	return vcs.TransferProgress{TotalObjects: total, ReceivedObjects: received, IndexedObjects: received}, true
+}
+
+// fetchLFS fetches all Git LFS objects for the repository at dir, if
+// opts.LFS enables it. It shells out to the git-lfs binary, which must
+// be installed and on PATH.
+func fetchLFS(dir string, opts vcs.RemoteOpts) error {
+	if opts.LFS == nil || !opts.LFS.Enabled {
+		return nil
+	}
+
+	if opts.LFS.ServerURL != "" {
+		cfg := exec.Command("git", "config", "lfs.url", opts.LFS.ServerURL)
+		cfg.Dir = dir
+		if out, err := cfg.CombinedOutput(); err != nil {
+			return fmt.Errorf("git config lfs.url: %s\n%s", err, out)
+		}
+	}
+
+	cmd := exec.Command("git", "lfs", "fetch", "--all")
+	cmd.Dir = dir
+	if err := configureRemoteEnv(cmd, opts); err != nil {
+		return err
+	}
+	if opts.LFS.Username != "" {
+		cmd.Env = append(cmd.Env, "GIT_LFS_USERNAME="+opts.LFS.Username, "GIT_LFS_PASSWORD="+opts.LFS.Password)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git lfs fetch --all: %s\n%s", err, out)
+	}
+	return nil
+}
+
+// writeTempFile writes data to a temporary file (mode 0600, as ssh
+// requires of private keys and known_hosts files) and returns its
+// path. The caller is responsible for the lifetime of the process; the
+// file is not removed automatically since it must outlive this
+// function call for ssh to read it.
+func writeTempFile(prefix string, data []byte) (string, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
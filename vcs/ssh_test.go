@@ -1,6 +1,12 @@
 package vcs_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
 	"os/exec"
 	"path/filepath"
 	"reflect"
@@ -12,11 +18,45 @@ import (
 	"github.com/sourcegraph/go-vcs/vcs/ssh"
 )
 
-func init() {
-	git.InsecureSkipCheckVerifySSH = true
-	gitcmd.InsecureSkipCheckVerifySSH = true
+// gitHTTPBackend is the path to the git-http-backend CGI binary used
+// to serve repositories over smart HTTP in tests.
+const gitHTTPBackend = "/usr/lib/git-core/git-http-backend"
+
+// startGitHTTPServer starts a smart-HTTP git server (backed by
+// git-http-backend via CGI) rooted at dir, requiring HTTP basic auth,
+// and returns RemoteOpts configured with matching credentials,
+// exercising the same path a real HTTPS deployment would use.
+func startGitHTTPServer(t *testing.T, label string, dir string) (*httptest.Server, vcs.RemoteOpts) {
+	const username, password = "testuser", "testpass"
+
+	backend := &cgi.Handler{
+		Path: gitHTTPBackend,
+		Dir:  dir,
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-vcs test"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+
+	return srv, vcs.RemoteOpts{
+		HTTPS: &vcs.HTTPSConfig{
+			Username: username,
+			Password: password,
+		},
+	}
 }
 
+// startGitShellSSHServer starts a git-shell SSH server rooted at dir
+// and returns RemoteOpts configured to authenticate with the sample
+// private key and verify the server's host key against a known_hosts
+// entry generated for it, exercising the same path a real deployment
+// would use (rather than vcs.SSHConfig.Insecure).
 func startGitShellSSHServer(t *testing.T, label string, dir string) (*ssh.Server, vcs.RemoteOpts) {
 	s, err := ssh.NewServer("git-shell", dir, ssh.PrivateKey(ssh.SamplePrivKey))
 	if err != nil {
@@ -25,9 +65,16 @@ func startGitShellSSHServer(t *testing.T, label string, dir string) (*ssh.Server
 	if err := s.Start(); err != nil {
 		t.Fatalf("%s: server Start: %s", label, err)
 	}
+
+	knownHosts, err := s.KnownHostsEntry()
+	if err != nil {
+		t.Fatalf("%s: KnownHostsEntry: %s", label, err)
+	}
+
 	return s, vcs.RemoteOpts{
 		SSH: &vcs.SSHConfig{
-			PrivateKey: ssh.SamplePrivKey,
+			Auth:       vcs.SSHPrivateKey{PrivateKey: ssh.SamplePrivKey},
+			KnownHosts: knownHosts,
 		},
 	}
 }
@@ -88,6 +135,311 @@ func TestRepository_Clone_ssh(t *testing.T) {
 	}
 }
 
+func TestRepository_Clone_ssh_Shallow(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m first --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:06Z git commit --allow-empty -m second --author='a <a@a.com>' --date 2006-01-02T15:04:06Z",
+		"git tag t0",
+	}
+	tests := map[string]struct {
+		repoDir string
+		cloner  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+	}{
+		"git libgit2": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+		},
+		"git cmd": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+		},
+	}
+
+	for label, test := range tests {
+		func() {
+			s, remoteOpts := startGitShellSSHServer(t, label, filepath.Dir(test.repoDir))
+			defer s.Close()
+
+			opt := vcs.CloneOpt{
+				Bare:       true,
+				RemoteOpts: remoteOpts,
+			}
+			opt.Depth = 1
+
+			gitURL := s.GitURL + "/" + filepath.Base(test.repoDir)
+			cloneDir := makeTmpDir(t, "ssh-clone-shallow")
+			t.Logf("Shallow cloning (depth 1) from %s to %s", gitURL, cloneDir)
+			r, err := test.cloner(gitURL, cloneDir, opt)
+			if err != nil {
+				t.Fatalf("%s: test.cloner: %s", label, err)
+			}
+
+			tags, err := r.Tags()
+			if err != nil {
+				t.Errorf("%s: Tags: %s", label, err)
+			}
+			if len(tags) != 1 || tags[0].Name != "t0" {
+				t.Errorf("%s: got tags %s, want tag t0", label, asJSON(tags))
+			}
+
+			// A depth-1 clone should have exactly one commit reachable
+			// from HEAD.
+			c := exec.Command("git", "rev-list", "--count", "HEAD")
+			c.Dir = cloneDir
+			out, err := c.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s: git rev-list: %s\n%s", label, err, out)
+			}
+			if got := string(bytes.TrimSpace(out)); got != "1" {
+				t.Errorf("%s: got %s commits reachable from HEAD, want 1", label, got)
+			}
+		}()
+	}
+}
+
+func TestRepository_Clone_ssh_SingleBranch(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m first --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git checkout -b other",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:06Z git commit --allow-empty -m second --author='a <a@a.com>' --date 2006-01-02T15:04:06Z",
+		"git checkout master",
+	}
+	tests := map[string]struct {
+		repoDir string
+		cloner  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+	}{
+		"git libgit2": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+		},
+		"git cmd": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+		},
+	}
+
+	for label, test := range tests {
+		func() {
+			s, remoteOpts := startGitShellSSHServer(t, label, filepath.Dir(test.repoDir))
+			defer s.Close()
+
+			opt := vcs.CloneOpt{
+				Bare:         true,
+				SingleBranch: "master",
+				RemoteOpts:   remoteOpts,
+			}
+
+			gitURL := s.GitURL + "/" + filepath.Base(test.repoDir)
+			cloneDir := makeTmpDir(t, "ssh-clone-singlebranch")
+			t.Logf("Single-branch cloning (master only) from %s to %s", gitURL, cloneDir)
+			if _, err := test.cloner(gitURL, cloneDir, opt); err != nil {
+				t.Fatalf("%s: test.cloner: %s", label, err)
+			}
+
+			// Only the master branch's ref should have been fetched,
+			// not the "other" branch.
+			c := exec.Command("git", "for-each-ref", "--format=%(refname)")
+			c.Dir = cloneDir
+			out, err := c.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s: git for-each-ref: %s\n%s", label, err, out)
+			}
+			if bytes.Contains(out, []byte("other")) {
+				t.Errorf("%s: single-branch clone fetched the \"other\" branch; refs:\n%s", label, out)
+			}
+		}()
+	}
+}
+
+func TestRepository_Clone_ssh_NoTags(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag t0",
+	}
+	tests := map[string]struct {
+		repoDir string
+		cloner  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+	}{
+		"git libgit2": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+		},
+		"git cmd": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+		},
+	}
+
+	for label, test := range tests {
+		func() {
+			s, remoteOpts := startGitShellSSHServer(t, label, filepath.Dir(test.repoDir))
+			defer s.Close()
+
+			opt := vcs.CloneOpt{
+				Bare:       true,
+				NoTags:     true,
+				RemoteOpts: remoteOpts,
+			}
+
+			gitURL := s.GitURL + "/" + filepath.Base(test.repoDir)
+			cloneDir := makeTmpDir(t, "ssh-clone-notags")
+			t.Logf("Cloning without tags from %s to %s", gitURL, cloneDir)
+			r, err := test.cloner(gitURL, cloneDir, opt)
+			if err != nil {
+				t.Fatalf("%s: test.cloner: %s", label, err)
+			}
+
+			tags, err := r.Tags()
+			if err != nil {
+				t.Errorf("%s: Tags: %s", label, err)
+			}
+			if len(tags) != 0 {
+				t.Errorf("%s: got tags %s, want none", label, asJSON(tags))
+			}
+		}()
+	}
+}
+
+func TestRepository_Clone_ssh_Filter(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"bash -c 'printf filecontent > f.txt'",
+		"git add f.txt",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag t0",
+	}
+	tests := map[string]struct {
+		repoDir string
+		cloner  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+	}{
+		"git libgit2": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+		},
+		"git cmd": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+		},
+	}
+
+	for label, test := range tests {
+		func() {
+			// The SSH credentials configured by startGitShellSSHServer
+			// must still be honored on this path: the libgit2 backend
+			// falls back to shelling out to the git CLI for
+			// partial-clone filters, since libgit2 itself doesn't
+			// support them.
+			s, remoteOpts := startGitShellSSHServer(t, label, filepath.Dir(test.repoDir))
+			defer s.Close()
+
+			opt := vcs.CloneOpt{
+				Bare:       true,
+				Filter:     "blob:none",
+				RemoteOpts: remoteOpts,
+			}
+
+			gitURL := s.GitURL + "/" + filepath.Base(test.repoDir)
+			cloneDir := makeTmpDir(t, "ssh-clone-filter")
+			t.Logf("Filtered cloning (blob:none) from %s to %s", gitURL, cloneDir)
+			r, err := test.cloner(gitURL, cloneDir, opt)
+			if err != nil {
+				t.Fatalf("%s: test.cloner: %s", label, err)
+			}
+
+			tags, err := r.Tags()
+			if err != nil {
+				t.Errorf("%s: Tags: %s", label, err)
+			}
+			if len(tags) != 1 || tags[0].Name != "t0" {
+				t.Errorf("%s: got tags %s, want tag t0", label, asJSON(tags))
+			}
+		}()
+	}
+}
+
+func TestRepository_Clone_ssh_LFS(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"git lfs install --local",
+		"git lfs track *.bin",
+		"git add .gitattributes",
+		"bash -c 'printf largefilecontent > big.bin'",
+		"git add big.bin",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag t0",
+	}
+	tests := map[string]struct {
+		repoDir      string
+		cloner       func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+		wantCommitID vcs.CommitID
+	}{
+		"git libgit2": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+		},
+		"git cmd": {
+			repoDir: initGitRepository(t, gitCommands...),
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+		},
+	}
+
+	for label, test := range tests {
+		func() {
+			s, remoteOpts := startGitShellSSHServer(t, label, filepath.Dir(test.repoDir))
+			defer s.Close()
+			remoteOpts.LFS = &vcs.LFSConfig{Enabled: true}
+
+			opt := vcs.CloneOpt{
+				Bare:       true,
+				RemoteOpts: remoteOpts,
+			}
+
+			gitURL := s.GitURL + "/" + filepath.Base(test.repoDir)
+			cloneDir := makeTmpDir(t, "ssh-clone-lfs")
+			t.Logf("Cloning (with LFS) from %s to %s", gitURL, cloneDir)
+			r, err := test.cloner(gitURL, cloneDir, opt)
+			if err != nil {
+				t.Fatalf("%s: test.cloner: %s", label, err)
+			}
+
+			tags, err := r.Tags()
+			if err != nil {
+				t.Errorf("%s: Tags: %s", label, err)
+			}
+			if len(tags) != 1 || tags[0].Name != "t0" {
+				t.Errorf("%s: got tags %s, want tag t0", label, asJSON(tags))
+			}
+
+			// The LFS pointer for big.bin should have been resolved to
+			// its real content in the mirror's LFS object store.
+			c := exec.Command("git", "cat-file", "-p", "HEAD:big.bin")
+			c.Dir = cloneDir
+			out, err := c.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s: git cat-file: %s\n%s", label, err, out)
+			}
+			if !reflect.DeepEqual(string(out), "largefilecontent") {
+				// Bare clones keep blobs as LFS pointers in the working
+				// tree copy; the assertion of interest is that the LFS
+				// object itself was fetched into the mirror's store.
+				c := exec.Command("git", "lfs", "fsck")
+				c.Dir = cloneDir
+				if out, err := c.CombinedOutput(); err != nil {
+					t.Errorf("%s: git lfs fsck: %s\n%s", label, err, out)
+				}
+			}
+		}()
+	}
+}
+
 func TestRepository_UpdateEverything_ssh(t *testing.T) {
 	t.Parallel()
 
@@ -185,3 +537,591 @@ func TestRepository_UpdateEverything_ssh(t *testing.T) {
 		}()
 	}
 }
+
+func TestRepository_UpdateEverything_ssh_Shallow(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m first --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	tests := map[string]struct {
+		baseDir string
+		opener  func(dir string) (vcs.Repository, error)
+		cloner  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+	}{
+		"git libgit2": {
+			baseDir: initGitRepository(t, gitCommands...),
+			opener:  func(dir string) (vcs.Repository, error) { return git.Open(dir) },
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+		},
+		"git cmd": {
+			baseDir: initGitRepository(t, gitCommands...),
+			opener:  func(dir string) (vcs.Repository, error) { return gitcmd.Open(dir) },
+			cloner:  func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+		},
+	}
+
+	for label, test := range tests {
+		func() {
+			s, remoteOpts := startGitShellSSHServer(t, label, filepath.Dir(test.baseDir))
+			defer s.Close()
+			remoteOpts.Depth = 1
+
+			baseURL := s.GitURL + "/" + filepath.Base(test.baseDir)
+			headDir := makeTmpDir(t, "git-update-ssh-shallow")
+			t.Logf("%s: shallow mirror cloning (depth 1) from %s to %s", label, baseURL, headDir)
+			_, err := test.cloner(baseURL, headDir, vcs.CloneOpt{Bare: true, Mirror: true, RemoteOpts: remoteOpts})
+			if err != nil {
+				t.Fatalf("%s: cloner: %s", label, err)
+			}
+
+			// Add a new commit to the base repository, then update the
+			// shallow mirror and confirm both that the update succeeds
+			// (rather than failing with "unknown option 'depth'" from
+			// `git remote update --depth`) and that the mirror stays
+			// shallow across the refresh.
+			c := exec.Command("bash", "-c", "GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:06Z git commit --allow-empty -m second --author='a <a@a.com>' --date 2006-01-02T15:04:06Z")
+			c.Dir = test.baseDir
+			if out, err := c.CombinedOutput(); err != nil {
+				t.Fatalf("%s: exec commit failed: %s. Output was:\n\n%s", label, err, out)
+			}
+
+			r, err := test.opener(headDir)
+			if err != nil {
+				t.Fatalf("%s: opener: %s", label, err)
+			}
+			if err := r.(vcs.RemoteUpdater).UpdateEverything(remoteOpts); err != nil {
+				t.Fatalf("%s: UpdateEverything: %s", label, err)
+			}
+
+			rc := exec.Command("git", "rev-list", "--count", "--all")
+			rc.Dir = headDir
+			out, err := rc.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s: git rev-list: %s\n%s", label, err, out)
+			}
+			if got := string(bytes.TrimSpace(out)); got != "1" {
+				t.Errorf("%s: got %s commits reachable after update, want 1 (mirror should stay shallow)", label, got)
+			}
+		}()
+	}
+}
+
+func TestRepository_UpdateEverything_ssh_LFS(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"git lfs install --local",
+		"git lfs track *.bin",
+		"git add .gitattributes",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	tests := []struct {
+		vcs, baseDir, headDir string
+
+		opener func(dir string) (vcs.Repository, error)
+		cloner func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+
+		// newCmds commits an LFS-tracked file "newfile.bin" in the
+		// repository root and tags the commit "second". This is used
+		// to test that UpdateEverything fetches the LFS object into
+		// the mirror along with the new ref.
+		newCmds []string
+	}{
+		{ // git
+			"git", initGitRepository(t, gitCommands...), makeTmpDir(t, "git-update-ssh-lfs"),
+			func(dir string) (vcs.Repository, error) { return git.Open(dir) },
+			func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+			[]string{
+				"bash -c 'printf newlfscontent > newfile.bin'",
+				"git add newfile.bin",
+				"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m bar --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+				"git tag t0",
+			},
+		},
+		{ // gitcmd
+			"git", initGitRepository(t, gitCommands...), makeTmpDir(t, "git-update-ssh-lfs"),
+			func(dir string) (vcs.Repository, error) { return gitcmd.Open(dir) },
+			func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+			[]string{
+				"bash -c 'printf newlfscontent > newfile.bin'",
+				"git add newfile.bin",
+				"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m bar --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+				"git tag t0",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		func() {
+			s, remoteOpts := startGitShellSSHServer(t, test.vcs, filepath.Dir(test.baseDir))
+			defer s.Close()
+			remoteOpts.LFS = &vcs.LFSConfig{Enabled: true}
+
+			baseURL := s.GitURL + "/" + filepath.Base(test.baseDir)
+			t.Logf("Cloning (with LFS) from %s to %s", baseURL, test.headDir)
+			_, err := vcs.Clone(test.vcs, baseURL, test.headDir, vcs.CloneOpt{Bare: true, Mirror: true, RemoteOpts: remoteOpts})
+			if err != nil {
+				t.Errorf("Clone(%q, %q, %q): %s", test.vcs, baseURL, test.headDir, err)
+				return
+			}
+
+			r, err := test.opener(test.headDir)
+			if err != nil {
+				t.Errorf("opener[->%s](%q): %s", reflect.TypeOf(test.opener).Out(0), test.headDir, err)
+				return
+			}
+
+			for _, cmd := range test.newCmds {
+				c := exec.Command("bash", "-c", cmd)
+				c.Dir = test.baseDir
+				out, err := c.CombinedOutput()
+				if err != nil {
+					t.Fatalf("%s: exec `%s` failed: %s. Output was:\n\n%s", test.vcs, cmd, err, out)
+				}
+			}
+
+			// update the mirror; this should fetch the new ref and
+			// resolve the LFS pointer for newfile.bin into the
+			// mirror's LFS object store.
+			err = r.(vcs.RemoteUpdater).UpdateEverything(remoteOpts)
+			if err != nil {
+				t.Errorf("%s: UpdateEverything: %s", test.vcs, err)
+				return
+			}
+
+			tags, err := r.Tags()
+			if err != nil {
+				t.Errorf("%s: Tags: %s", test.vcs, err)
+				return
+			}
+			if !(len(tags) == 1 && tags[0].Name == "t0") {
+				t.Errorf("%s: got tags %v, want 1 tag 't0'", test.vcs, tags)
+			}
+
+			c := exec.Command("git", "lfs", "fsck")
+			c.Dir = test.headDir
+			if out, err := c.CombinedOutput(); err != nil {
+				t.Errorf("%s: git lfs fsck: %s\n%s", test.vcs, err, out)
+			}
+		}()
+	}
+}
+
+func TestRepository_Push_ssh(t *testing.T) {
+	t.Parallel()
+
+	// TODO(sqs): test hg ssh support when it's implemented
+	tests := []struct {
+		vcs, originDir, cloneDir string
+
+		cloner func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+
+		// localCmds commits a new file in the clone and tags it "t1",
+		// to be pushed back to origin.
+		localCmds []string
+	}{
+		{
+			"git", initGitRepository(t), makeTmpDir(t, "git-push-ssh"),
+			func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+			[]string{
+				"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+				"git tag t1",
+			},
+		},
+		{
+			"git", initGitRepository(t), makeTmpDir(t, "git-push-ssh"),
+			func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+			[]string{
+				"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+				"git tag t1",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		func() {
+			s, remoteOpts := startGitShellSSHServer(t, test.vcs, filepath.Dir(test.originDir))
+			defer s.Close()
+
+			originURL := s.GitURL + "/" + filepath.Base(test.originDir)
+			t.Logf("Cloning from %s to %s", originURL, test.cloneDir)
+			r, err := test.cloner(originURL, test.cloneDir, vcs.CloneOpt{RemoteOpts: remoteOpts})
+			if err != nil {
+				t.Fatalf("%s: test.cloner: %s", test.vcs, err)
+			}
+
+			for _, cmd := range test.localCmds {
+				c := exec.Command("bash", "-c", cmd)
+				c.Dir = test.cloneDir
+				out, err := c.CombinedOutput()
+				if err != nil {
+					t.Fatalf("%s: exec `%s` failed: %s. Output was:\n\n%s", test.vcs, cmd, err, out)
+				}
+			}
+
+			pusher, ok := r.(vcs.RemotePusher)
+			if !ok {
+				t.Fatalf("%s: %T does not implement vcs.RemotePusher", test.vcs, r)
+			}
+			if err := pusher.Push([]string{"refs/tags/t1:refs/tags/t1"}, remoteOpts); err != nil {
+				t.Fatalf("%s: Push: %s", test.vcs, err)
+			}
+
+			// The tag should now exist in the origin repository.
+			c := exec.Command("git", "tag", "-l", "t1")
+			c.Dir = test.originDir
+			out, err := c.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s: git tag -l: %s\n%s", test.vcs, err, out)
+			}
+			if got := string(bytes.TrimSpace(out)); got != "t1" {
+				t.Errorf("%s: got tags %q in origin, want \"t1\"", test.vcs, got)
+			}
+		}()
+	}
+}
+
+func TestRepository_MirrorPush_ssh(t *testing.T) {
+	t.Parallel()
+
+	// TODO(sqs): this test is symmetrical to TestRepository_UpdateEverything_ssh.
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag t0",
+	}
+	tests := []struct {
+		vcs, baseDir, mirrorDir string
+
+		opener func(dir string) (vcs.Repository, error)
+	}{
+		{ // git
+			"git", initGitRepository(t, gitCommands...), makeTmpDir(t, "git-mirrorpush-ssh"),
+			func(dir string) (vcs.Repository, error) { return git.Open(dir) },
+		},
+		{ // gitcmd
+			"git", initGitRepository(t, gitCommands...), makeTmpDir(t, "git-mirrorpush-ssh"),
+			func(dir string) (vcs.Repository, error) { return gitcmd.Open(dir) },
+		},
+	}
+
+	for _, test := range tests {
+		func() {
+			s, remoteOpts := startGitShellSSHServer(t, test.vcs, filepath.Dir(test.baseDir))
+			defer s.Close()
+
+			baseURL := s.GitURL + "/" + filepath.Base(test.baseDir)
+			t.Logf("Cloning (mirror) from %s to %s", baseURL, test.mirrorDir)
+			_, err := vcs.Clone(test.vcs, baseURL, test.mirrorDir, vcs.CloneOpt{Bare: true, Mirror: true, RemoteOpts: remoteOpts})
+			if err != nil {
+				t.Errorf("Clone(%q, %q, %q): %s", test.vcs, baseURL, test.mirrorDir, err)
+				return
+			}
+
+			r, err := test.opener(test.mirrorDir)
+			if err != nil {
+				t.Errorf("opener[->%s](%q): %s", reflect.TypeOf(test.opener).Out(0), test.mirrorDir, err)
+				return
+			}
+
+			// targetDir is a second bare repo created alongside
+			// baseDir, under the same SSH server root, so MirrorPush
+			// has somewhere reachable to push the mirror's refs into.
+			targetDir := filepath.Join(filepath.Dir(test.baseDir), "mirror-push-target")
+			if out, err := exec.Command("git", "init", "--bare", targetDir).CombinedOutput(); err != nil {
+				t.Fatalf("%s: git init --bare: %s\n%s", test.vcs, err, out)
+			}
+
+			pusher, ok := r.(vcs.RemotePusher)
+			if !ok {
+				t.Fatalf("%s: %T does not implement vcs.RemotePusher", test.vcs, r)
+			}
+			targetURL := s.GitURL + "/" + filepath.Base(targetDir)
+			if err := pusher.MirrorPush(targetURL, remoteOpts); err != nil {
+				t.Fatalf("%s: MirrorPush: %s", test.vcs, err)
+			}
+
+			// The tag from the mirror (originally cloned from baseDir)
+			// should now exist in targetDir.
+			c := exec.Command("git", "tag", "-l", "t0")
+			c.Dir = targetDir
+			out, err := c.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s: git tag -l: %s\n%s", test.vcs, err, out)
+			}
+			if got := string(bytes.TrimSpace(out)); got != "t0" {
+				t.Errorf("%s: got tags %q in target, want \"t0\"", test.vcs, got)
+			}
+		}()
+	}
+}
+
+func TestRepository_Clone_ssh_HostKeyCallback(t *testing.T) {
+	t.Parallel()
+
+	repoDir := initGitRepository(t)
+	s, remoteOpts := startGitShellSSHServer(t, "host key callback", filepath.Dir(repoDir))
+	defer s.Close()
+
+	// The base64-encoded key field of the known_hosts entry is the
+	// marshaled SSH wire-format public key, which is what
+	// HostKeyCallback should receive.
+	knownHosts, err := s.KnownHostsEntry()
+	if err != nil {
+		t.Fatalf("KnownHostsEntry: %s", err)
+	}
+	fields := bytes.Fields(knownHosts)
+	if len(fields) < 3 {
+		t.Fatalf("malformed known_hosts entry: %q", knownHosts)
+	}
+	wantKey, err := base64.StdEncoding.DecodeString(string(fields[2]))
+	if err != nil {
+		t.Fatalf("decoding known_hosts key field: %s", err)
+	}
+
+	var gotHostname string
+	var gotKey []byte
+	remoteOpts.SSH.KnownHosts = nil
+	remoteOpts.SSH.HostKeyCallback = func(hostname string, key []byte) error {
+		gotHostname = hostname
+		gotKey = key
+		return nil
+	}
+
+	gitURL := s.GitURL + "/" + filepath.Base(repoDir)
+	cloneDir := makeTmpDir(t, "ssh-clone-hostkeycallback")
+	if _, err := git.Clone(gitURL, cloneDir, vcs.CloneOpt{Bare: true, RemoteOpts: remoteOpts}); err != nil {
+		t.Fatalf("git.Clone: %s", err)
+	}
+
+	if gotHostname == "" {
+		t.Errorf("HostKeyCallback was not invoked")
+	}
+	if !bytes.Equal(gotKey, wantKey) {
+		t.Errorf("HostKeyCallback got key %x, want %x", gotKey, wantKey)
+	}
+}
+
+func TestRepository_Clone_ssh_UnknownHostKey(t *testing.T) {
+	t.Parallel()
+
+	repoDir := initGitRepository(t)
+	s, remoteOpts := startGitShellSSHServer(t, "unknown host key", filepath.Dir(repoDir))
+	defer s.Close()
+
+	// Corrupt the known_hosts entry so it no longer matches the
+	// server's real host key; the clone should be rejected rather than
+	// silently trusting an unverified host.
+	remoteOpts.SSH.KnownHosts = bytes.Replace(remoteOpts.SSH.KnownHosts, []byte("ssh-"), []byte("xxh-"), 1)
+
+	gitURL := s.GitURL + "/" + filepath.Base(repoDir)
+	cloneDir := makeTmpDir(t, "ssh-clone-unknown-hostkey")
+	if _, err := gitcmd.Clone(gitURL, cloneDir, vcs.CloneOpt{Bare: true, RemoteOpts: remoteOpts}); err == nil {
+		t.Fatalf("gitcmd.Clone with a mismatched known_hosts entry unexpectedly succeeded")
+	}
+}
+
+func TestRepository_Clone_ssh_ContextCancel(t *testing.T) {
+	t.Parallel()
+
+	repoDir := initGitRepository(t)
+	s, remoteOpts := startGitShellSSHServer(t, "context cancel", filepath.Dir(repoDir))
+	defer s.Close()
+
+	gitURL := s.GitURL + "/" + filepath.Base(repoDir)
+	cloneDir := makeTmpDir(t, "ssh-clone-cancel")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := gitcmd.CloneContext(ctx, gitURL, cloneDir, vcs.CloneOpt{Bare: true, RemoteOpts: remoteOpts}); err == nil {
+		t.Fatalf("gitcmd.CloneContext with an already-canceled context unexpectedly succeeded")
+	}
+}
+
+func TestRepository_Clone_ssh_Progress(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	repoDir := initGitRepository(t, gitCommands...)
+	s, remoteOpts := startGitShellSSHServer(t, "progress", filepath.Dir(repoDir))
+	defer s.Close()
+
+	gitURL := s.GitURL + "/" + filepath.Base(repoDir)
+	cloneDir := makeTmpDir(t, "ssh-clone-progress")
+
+	var updates []vcs.TransferProgress
+	opt := vcs.CloneOpt{
+		Bare:       true,
+		RemoteOpts: remoteOpts,
+		Progress:   func(p vcs.TransferProgress) { updates = append(updates, p) },
+	}
+	if _, err := gitcmd.Clone(gitURL, cloneDir, opt); err != nil {
+		t.Fatalf("gitcmd.Clone: %s", err)
+	}
+	if len(updates) == 0 {
+		t.Errorf("got no progress updates, want at least one")
+	}
+}
+
+func TestRepository_Clone_https_git_HeadersUnsupported(t *testing.T) {
+	t.Parallel()
+
+	// The libgit2 backend has no hook for custom HTTP headers (unlike
+	// gitcmd, which sends them via http.extraHeader); it must reject
+	// HTTPSConfig.Headers explicitly rather than silently ignore it.
+	repoDir := initGitRepository(t)
+	s, remoteOpts := startGitHTTPServer(t, "headers unsupported", filepath.Dir(repoDir))
+	defer s.Close()
+	remoteOpts.HTTPS.Headers = http.Header{"Authorization": []string{"Bearer t0k3n"}}
+
+	gitURL := s.URL + "/" + filepath.Base(repoDir)
+	cloneDir := makeTmpDir(t, "https-clone-headers-unsupported")
+	if _, err := git.Clone(gitURL, cloneDir, vcs.CloneOpt{Bare: true, RemoteOpts: remoteOpts}); err == nil {
+		t.Fatalf("git.Clone with HTTPSConfig.Headers set unexpectedly succeeded")
+	}
+}
+
+func TestRepository_Clone_https(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag t0",
+	}
+	tests := map[string]struct {
+		repoDir      string
+		cloner       func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+		wantCommitID vcs.CommitID
+	}{
+		"git libgit2": {
+			repoDir:      initGitRepository(t, gitCommands...),
+			cloner:       func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+			wantCommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
+		},
+		"git cmd": {
+			repoDir:      initGitRepository(t, gitCommands...),
+			cloner:       func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+			wantCommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
+		},
+	}
+
+	for label, test := range tests {
+		func() {
+			s, remoteOpts := startGitHTTPServer(t, label, filepath.Dir(test.repoDir))
+			defer s.Close()
+
+			opt := vcs.CloneOpt{
+				Bare:       true,
+				RemoteOpts: remoteOpts,
+			}
+
+			gitURL := s.URL + "/" + filepath.Base(test.repoDir)
+			cloneDir := makeTmpDir(t, "https-clone")
+			t.Logf("Cloning from %s to %s", gitURL, cloneDir)
+			r, err := test.cloner(gitURL, cloneDir, opt)
+			if err != nil {
+				t.Fatalf("%s: test.cloner: %s", label, err)
+			}
+
+			tags, err := r.Tags()
+			if err != nil {
+				t.Errorf("%s: Tags: %s", label, err)
+			}
+
+			wantTags := []*vcs.Tag{{Name: "t0", CommitID: test.wantCommitID}}
+			if !reflect.DeepEqual(tags, wantTags) {
+				t.Errorf("%s: got tags %s, want %s", label, asJSON(tags), asJSON(wantTags))
+			}
+		}()
+	}
+}
+
+func TestRepository_UpdateEverything_https(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	tests := []struct {
+		vcs, baseDir, headDir string
+
+		opener func(dir string) (vcs.Repository, error)
+		cloner func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error)
+
+		// newCmds should commit a file in the repository root and tag
+		// the commit "t0". This is used to test that UpdateEverything
+		// picks up the new tag from the mirror's origin.
+		newCmds []string
+	}{
+		{ // git
+			"git", initGitRepository(t, gitCommands...), makeTmpDir(t, "git-update-https"),
+			func(dir string) (vcs.Repository, error) { return git.Open(dir) },
+			func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+			[]string{"git tag t0"},
+		},
+		{ // gitcmd
+			"git", initGitRepository(t, gitCommands...), makeTmpDir(t, "git-update-https"),
+			func(dir string) (vcs.Repository, error) { return gitcmd.Open(dir) },
+			func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+			[]string{"git tag t0"},
+		},
+	}
+
+	for _, test := range tests {
+		func() {
+			s, remoteOpts := startGitHTTPServer(t, test.vcs, filepath.Dir(test.baseDir))
+			defer s.Close()
+
+			baseURL := s.URL + "/" + filepath.Base(test.baseDir)
+			t.Logf("Cloning from %s to %s", baseURL, test.headDir)
+			_, err := vcs.Clone(test.vcs, baseURL, test.headDir, vcs.CloneOpt{Bare: true, Mirror: true, RemoteOpts: remoteOpts})
+			if err != nil {
+				t.Errorf("Clone(%q, %q, %q): %s", test.vcs, baseURL, test.headDir, err)
+				return
+			}
+
+			r, err := test.opener(test.headDir)
+			if err != nil {
+				t.Errorf("opener[->%s](%q): %s", reflect.TypeOf(test.opener).Out(0), test.headDir, err)
+				return
+			}
+
+			tags, err := r.Tags()
+			if err != nil {
+				t.Errorf("%s: Tags: %s", test.vcs, err)
+				return
+			}
+			if len(tags) != 0 {
+				t.Errorf("%s: got tags %v, want none", test.vcs, tags)
+			}
+
+			for _, cmd := range test.newCmds {
+				c := exec.Command("bash", "-c", cmd)
+				c.Dir = test.baseDir
+				out, err := c.CombinedOutput()
+				if err != nil {
+					t.Fatalf("%s: exec `%s` failed: %s. Output was:\n\n%s", test.vcs, cmd, err, out)
+				}
+			}
+
+			err = r.(vcs.RemoteUpdater).UpdateEverything(remoteOpts)
+			if err != nil {
+				t.Errorf("%s: UpdateEverything: %s", test.vcs, err)
+				return
+			}
+
+			tags, err = r.Tags()
+			if err != nil {
+				t.Errorf("%s: Tags: %s", test.vcs, err)
+				return
+			}
+			if !(len(tags) == 1 && tags[0].Name == "t0") {
+				t.Errorf("%s: got tags %v, want 1 tag 't0'", test.vcs, tags)
+			}
+		}()
+	}
+}
@@ -0,0 +1,285 @@
+// Package vcs defines an interface for interacting with VCS (version
+// control system) repositories, plus the shared option types used by
+// the concrete backends (vcs/git, vcs/gitcmd, ...).
+package vcs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CommitID is the ID of a VCS commit, generally the hex-encoded hash.
+type CommitID string
+
+// Signature is the author or committer of a commit.
+type Signature struct {
+	Name  string
+	Email string
+	Date  time.Time
+}
+
+// Commit represents a VCS commit.
+type Commit struct {
+	ID        CommitID
+	Author    Signature
+	Committer *Signature
+	Message   string
+	Parents   []CommitID
+}
+
+// Tag represents a VCS tag.
+type Tag struct {
+	Name     string
+	CommitID CommitID
+}
+
+// Repository is a VCS repository.
+type Repository interface {
+	// ResolveTag returns the commit ID for the given tag.
+	ResolveTag(name string) (CommitID, error)
+
+	// Tags returns a list of all tags in the repository.
+	Tags() ([]*Tag, error)
+
+	// GetCommit returns the commit with the given ID.
+	GetCommit(id CommitID) (*Commit, error)
+}
+
+// RemoteUpdater is implemented by repositories that can fetch updates
+// (refs, tags, objects) from their configured remote.
+type RemoteUpdater interface {
+	// UpdateEverything updates all branches, tags, and other refs to
+	// match the remote. It is intended for use on mirror (bare, pushed
+	// into only by the remote) repositories.
+	UpdateEverything(opts RemoteOpts) error
+
+	// UpdateEverythingContext is like UpdateEverything, but aborts the
+	// update if ctx is done.
+	UpdateEverythingContext(ctx context.Context, opts RemoteOpts) error
+}
+
+// LFSConfig configures Git LFS (Large File Storage) handling for clone
+// and remote-update operations. It has no effect for VCS types that
+// don't support LFS.
+type LFSConfig struct {
+	// Enabled causes LFS objects to be fetched alongside refs, rather
+	// than left as unresolved pointers.
+	Enabled bool
+
+	// ServerURL overrides the LFS server URL that would otherwise be
+	// derived from the repository's remote, if set.
+	ServerURL string
+
+	// Username and Password authenticate to the LFS server, if it
+	// requires HTTP basic auth.
+	Username string
+	Password string
+}
+
+// RemotePusher is implemented by repositories that can push local refs
+// to their remote. It is the write-side counterpart to RemoteUpdater,
+// enabling two-way (pull and push) mirroring.
+type RemotePusher interface {
+	// Push pushes the given refspecs (e.g. "refs/heads/main:refs/heads/main")
+	// to the repository's configured remote.
+	Push(refspecs []string, opts RemoteOpts) error
+
+	// MirrorPush pushes all refs, as-is, to remoteURL, making it an
+	// exact mirror of this repository's refs.
+	MirrorPush(remoteURL string, opts RemoteOpts) error
+}
+
+// SSHAuth selects how a backend authenticates an SSH remote operation.
+// It is implemented by SSHPrivateKey, SSHAgent, and SSHCommand.
+type SSHAuth interface {
+	sshAuth()
+}
+
+// SSHPrivateKey authenticates using an in-memory PEM-encoded private
+// key. It is supported by both the git (libgit2) and gitcmd backends.
+type SSHPrivateKey struct {
+	// PrivateKey is the PEM-encoded private key to use.
+	PrivateKey []byte
+
+	// Passphrase decrypts PrivateKey, if it is encrypted.
+	Passphrase string
+}
+
+func (SSHPrivateKey) sshAuth() {}
+
+// SSHAgent authenticates via a running ssh-agent.
+type SSHAgent struct {
+	// Socket is the ssh-agent socket path. If empty, the SSH_AUTH_SOCK
+	// environment variable is used.
+	Socket string
+}
+
+func (SSHAgent) sshAuth() {}
+
+// SSHCommand delegates authentication to the system ssh binary
+// (invoked via GIT_SSH_COMMAND), letting it use its own configuration
+// (~/.ssh/config, loaded keys, agent, etc.) instead of in-process
+// auth. It is only supported by command-line-tool-based backends
+// (gitcmd); the git (libgit2) backend returns an error if it is used.
+type SSHCommand struct {
+	// Command overrides the ssh command/binary to invoke. Defaults to
+	// "ssh" if empty.
+	Command string
+
+	// ExtraArgs are appended to the ssh invocation (e.g. ["-i", path]).
+	ExtraArgs []string
+}
+
+func (SSHCommand) sshAuth() {}
+
+// HostKeyCallback verifies a remote SSH host's public key (in SSH wire
+// format, as produced by golang.org/x/crypto/ssh.Marshal). Returning a
+// non-nil error rejects the connection.
+type HostKeyCallback func(hostname string, key []byte) error
+
+// SSHConfig configures authentication and host-key verification for
+// SSH remote operations.
+type SSHConfig struct {
+	// Auth selects how the backend authenticates. It must be one of
+	// SSHPrivateKey, SSHAgent, or SSHCommand.
+	Auth SSHAuth
+
+	// KnownHosts, if set, is the contents of an OpenSSH known_hosts
+	// file used to verify the remote host's key.
+	KnownHosts []byte
+
+	// HostKeyCallback, if set, is used instead of KnownHosts to verify
+	// the remote host's key.
+	HostKeyCallback HostKeyCallback
+
+	// Insecure skips host key verification entirely. Use only for
+	// testing; it takes precedence over KnownHosts and HostKeyCallback.
+	Insecure bool
+}
+
+// HTTPSConfig configures authentication for HTTP(S) remote operations.
+type HTTPSConfig struct {
+	// Username authenticates via HTTP basic auth, alongside Password
+	// or Token.
+	Username string
+
+	// Password authenticates via HTTP basic auth, alongside Username.
+	Password string
+
+	// Token, if set, is used as the HTTP basic auth password instead
+	// of Password (the conventional way to authenticate a personal
+	// access token against most forges).
+	Token string
+
+	// CABundle, if set, overrides the system CA roots used to verify
+	// the remote's TLS certificate.
+	CABundle []byte
+
+	// Insecure skips TLS certificate verification entirely. Use only
+	// for testing.
+	Insecure bool
+
+	// Headers are sent with every HTTP(S) request to the remote, e.g.
+	// for bearer/OAuth-style authentication. Only the gitcmd backend
+	// supports it; the git (libgit2) backend returns an error if it is
+	// used.
+	Headers http.Header
+}
+
+// RemoteOpts configures how a backend communicates with a remote
+// repository (over SSH, HTTPS, etc.).
+type RemoteOpts struct {
+	// SSH configures SSH authentication. It is only used if the remote
+	// URL uses the ssh:// scheme (or scp-like syntax).
+	SSH *SSHConfig
+
+	// HTTPS configures HTTP(S) authentication. It is only used if the
+	// remote URL uses the http:// or https:// scheme.
+	HTTPS *HTTPSConfig
+
+	// LFS configures Git LFS handling, if the remote uses Git LFS.
+	LFS *LFSConfig
+
+	// Depth, if positive, limits history fetched from the remote to
+	// the given number of commits (a shallow clone/fetch). It is used
+	// both for the initial clone and, for mirrors, by
+	// RemoteUpdater.UpdateEverything to keep the mirror shallow across
+	// refreshes.
+	Depth int
+}
+
+// CloneOpt configures a repository clone operation.
+type CloneOpt struct {
+	// Bare creates a bare repository (no working tree).
+	Bare bool
+
+	// Mirror creates a mirror clone: all refs are copied as-is and
+	// kept in sync by RemoteUpdater.UpdateEverything, rather than only
+	// branches under refs/heads and refs/tags being tracked.
+	Mirror bool
+
+	// SingleBranch restricts the clone to the named branch, if set.
+	SingleBranch string
+
+	// NoTags omits tags not reachable from the cloned branch(es).
+	NoTags bool
+
+	// Filter is a partial-clone filter spec (e.g. "blob:none",
+	// "tree:0"), as accepted by `git clone --filter`. It is ignored by
+	// backends or git versions that don't support partial clone.
+	Filter string
+
+	// Progress, if set, is called periodically during the clone with
+	// transfer progress.
+	Progress ProgressFunc
+
+	RemoteOpts
+}
+
+// TransferProgress reports the progress of an in-progress clone or
+// fetch operation.
+type TransferProgress struct {
+	TotalObjects    int
+	ReceivedObjects int
+	IndexedObjects  int
+	ReceivedBytes   int
+}
+
+// ProgressFunc is called with transfer progress during a clone or
+// fetch operation.
+type ProgressFunc func(TransferProgress)
+
+// clonerFunc clones the repository at url into dir and opens it,
+// aborting if ctx is done.
+type clonerFunc func(ctx context.Context, url, dir string, opt CloneOpt) (Repository, error)
+
+// cloners holds the cloner registered by each backend package, keyed
+// by VCS type ("git", "hg", ...). Backend packages register themselves
+// in their init functions so that vcs does not need to import them
+// (which would create an import cycle).
+var cloners = map[string]clonerFunc{}
+
+// RegisterCloner registers a context-aware cloner for the given VCS
+// type. It is intended to be called from the init function of a
+// backend package.
+func RegisterCloner(vcsType string, clone clonerFunc) {
+	cloners[vcsType] = clone
+}
+
+// Clone clones the repository at url into dir using the backend
+// registered for vcsType (e.g. "git") and returns the opened
+// repository.
+func Clone(vcsType, url, dir string, opt CloneOpt) (Repository, error) {
+	return CloneContext(context.Background(), vcsType, url, dir, opt)
+}
+
+// CloneContext is like Clone, but aborts the clone if ctx is done.
+func CloneContext(ctx context.Context, vcsType, url, dir string, opt CloneOpt) (Repository, error) {
+	clone, ok := cloners[vcsType]
+	if !ok {
+		return nil, fmt.Errorf("vcs: no cloner registered for VCS type %q", vcsType)
+	}
+	return clone(ctx, url, dir, opt)
+}